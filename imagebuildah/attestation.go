@@ -0,0 +1,410 @@
+package imagebuildah
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/signature"
+	is "github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openshift/imagebuilder"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SBOMGenerator produces a software bill of materials for a build's final
+// rootfs.  Format is a short, human-readable name for the document's kind
+// (e.g. "spdx" or "cyclonedx"); it's used to name the artifact and has no
+// parsing significance to Executor.
+type SBOMGenerator interface {
+	Generate(ctx context.Context, rootfs string) (format string, document []byte, err error)
+}
+
+// Attestation describes one document (an SBOM or the provenance predicate)
+// that Executor produced for a built image, and where it ended up.
+type Attestation struct {
+	// ArtifactType names what kind of document this is, e.g. "spdx",
+	// "cyclonedx", or "in-toto-provenance".
+	ArtifactType string
+	// Digest is the content digest of the document, suitable for pinning.
+	Digest digest.Digest
+	// Ref is set if the document was pushed to a registry alongside the
+	// image, referring to the image manifest via the OCI 1.1 subject
+	// field.
+	Ref reference.Canonical
+}
+
+// BuildResult is returned by Executor.Build.  It exists so that
+// Build can report attestation artifact digests in addition to the image it
+// produced, without piling on more named return values.
+type BuildResult struct {
+	ImageID      string
+	Ref          reference.Canonical
+	Attestations []Attestation
+}
+
+// stageTiming records when a stage started and finished running, for
+// inclusion in the provenance predicate.
+type stageTiming struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// provenancePredicate is a reduced, SLSA-style in-toto provenance predicate.
+// It isn't a complete implementation of any particular SLSA level, but it
+// captures the facts a consumer needs to judge how an image was built.
+type provenancePredicate struct {
+	BuildType   string               `json:"buildType"`
+	Invocation  provenanceInvoke     `json:"invocation"`
+	Materials   []provenanceMaterial `json:"materials"`
+	BuildConfig provenanceConfig     `json:"buildConfig"`
+}
+
+type provenanceInvoke struct {
+	ConfigSource string            `json:"configSource"` // Dockerfile digest
+	Parameters   map[string]string `json:"parameters"`   // consumed build args
+}
+
+type provenanceMaterial struct {
+	URI    string `json:"uri"`    // base image name
+	Digest string `json:"digest"` // resolved digest, if known
+}
+
+type provenanceConfig struct {
+	Architecture string        `json:"architecture"`
+	OS           string        `json:"os"`
+	Stages       []stageTiming `json:"stages"`
+}
+
+const provenanceBuildType = "https://github.com/containers/buildah/docs/buildtype@v1"
+
+// recordStageTiming notes a stage's start/end time for the provenance
+// predicate; it's a no-op unless attestations were requested.
+func (b *Executor) recordStageTiming(name string, started, finished time.Time) {
+	if len(b.sbomGenerators) == 0 && !b.emitProvenance {
+		return
+	}
+	b.stagesLock.Lock()
+	defer b.stagesLock.Unlock()
+	if b.stageTimings == nil {
+		b.stageTimings = make(map[string]stageTiming)
+	}
+	b.stageTimings[name] = stageTiming{Name: name, StartedAt: started, FinishedAt: finished}
+}
+
+// attestFinalImage runs the configured SBOM generators and/or synthesizes a
+// provenance predicate for the image that the last stage produced, reusing
+// that stage's already-mounted rootfs rather than extracting it again.
+func (b *Executor) attestFinalImage(ctx context.Context, dockerfileDigest digest.Digest, stages imagebuilder.Stages, imageID string) ([]Attestation, error) {
+	if len(b.sbomGenerators) == 0 && !b.emitProvenance {
+		return nil, nil
+	}
+
+	lastStage := stages[len(stages)-1].Name
+	stageExecutor, ok := b.stages[lastStage]
+	if !ok || stageExecutor.builder == nil {
+		return nil, errors.Errorf("error generating attestations: no build container for final stage %q", lastStage)
+	}
+
+	rootfs, err := stageExecutor.builder.Mount("")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error mounting final stage %q to generate attestations", lastStage)
+	}
+	defer func() {
+		if err := stageExecutor.builder.Unmount(); err != nil {
+			logrus.Debugf("error unmounting final stage %q after generating attestations: %v", lastStage, err)
+		}
+	}()
+
+	var attestations []Attestation
+	for _, generator := range b.sbomGenerators {
+		format, document, genErr := generator.Generate(ctx, rootfs)
+		if genErr != nil {
+			return attestations, errors.Wrapf(genErr, "error generating %s attestation", format)
+		}
+		att, storeErr := b.storeAttestation(ctx, imageID, format, document)
+		if storeErr != nil {
+			return attestations, storeErr
+		}
+		attestations = append(attestations, att)
+	}
+
+	if b.emitProvenance {
+		predicate := b.buildProvenancePredicate(dockerfileDigest)
+		document, marshalErr := json.Marshal(predicate)
+		if marshalErr != nil {
+			return attestations, errors.Wrap(marshalErr, "error marshaling provenance predicate")
+		}
+		att, storeErr := b.storeAttestation(ctx, imageID, "in-toto-provenance", document)
+		if storeErr != nil {
+			return attestations, storeErr
+		}
+		attestations = append(attestations, att)
+	}
+
+	return attestations, nil
+}
+
+// storeAttestation records document as big-data on the image under a
+// per-format key, and pushes it to the output registry alongside the image
+// when one is configured, returning the digest it was stored under.
+func (b *Executor) storeAttestation(ctx context.Context, imageID, artifactType string, document []byte) (Attestation, error) {
+	dgst := digest.FromBytes(document)
+	key := fmt.Sprintf("attestation-%s", artifactType)
+	if err := b.store.SetImageBigData(imageID, key, document, nil); err != nil {
+		return Attestation{}, errors.Wrapf(err, "error recording %s attestation", artifactType)
+	}
+
+	att := Attestation{ArtifactType: artifactType, Digest: dgst}
+	if ref, err := b.pushAttestationArtifact(ctx, imageID, artifactType, document); err != nil {
+		logrus.Warnf("attestation: failed to push %s document alongside %s: %v", artifactType, b.output, err)
+	} else {
+		att.Ref = ref
+	}
+	return att, nil
+}
+
+// buildProvenancePredicate captures the inputs that determined the shape of
+// the final image: the Dockerfile digest, the resolved digests of every
+// named base image, the non-builtin build args that were actually
+// consumed, the host architecture/OS, and each stage's start/end time.
+func (b *Executor) buildProvenancePredicate(dockerfileDigest digest.Digest) provenancePredicate {
+	b.stagesLock.Lock()
+	materials := make([]provenanceMaterial, 0, len(b.baseMap))
+	for base, dgst := range b.baseMap {
+		materials = append(materials, provenanceMaterial{URI: base, Digest: dgst.String()})
+	}
+	b.stagesLock.Unlock()
+
+	params := make(map[string]string)
+	for arg, value := range b.consumedArgs() {
+		params[arg] = value
+	}
+
+	b.stagesLock.Lock()
+	stageList := make([]stageTiming, 0, len(b.stageTimings))
+	for _, t := range b.stageTimings {
+		stageList = append(stageList, t)
+	}
+	b.stagesLock.Unlock()
+
+	return provenancePredicate{
+		BuildType: provenanceBuildType,
+		Invocation: provenanceInvoke{
+			ConfigSource: dockerfileDigest.String(),
+			Parameters:   params,
+		},
+		Materials: materials,
+		BuildConfig: provenanceConfig{
+			Architecture: firstNonEmpty(b.architecture, runtime.GOARCH),
+			OS:           firstNonEmpty(b.os, runtime.GOOS),
+			Stages:       stageList,
+		},
+	}
+}
+
+// emptyOCIConfig is "{}", the config blob OCI 1.1 uses for artifact
+// manifests that have no meaningful config of their own.
+var emptyOCIConfig = []byte("{}")
+
+// pushAttestationArtifact pushes the attestation document to the output
+// registry alongside the image it describes, as a small OCI 1.1 artifact
+// manifest whose "subject" field points back at the image's own manifest,
+// so that clients can discover it without knowing any tag naming scheme in
+// advance, and signs it with the executor's SignBy key, if one was given,
+// just like an image push would.  The document itself is still recorded
+// locally by storeAttestation via SetImageBigData regardless of whether this
+// succeeds.
+func (b *Executor) pushAttestationArtifact(ctx context.Context, imageID, artifactType string, document []byte) (reference.Canonical, error) {
+	if b.output == "" {
+		return nil, nil
+	}
+	dest, err := b.resolveNameToImageRef(b.output)
+	if err != nil {
+		return nil, err
+	}
+	if dest.Transport().Name() == is.Transport.Name() {
+		// Output is going to local storage, not a registry; nothing to
+		// push alongside.
+		return nil, nil
+	}
+
+	subjectDigest, subjectSize, err := b.imageManifestInfo(ctx, dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading manifest of %q to attach attestation as a referrer", b.output)
+	}
+
+	dockerRef := dest.DockerReference()
+	if dockerRef == nil {
+		return nil, errors.Errorf("output %q has no registry reference to attach an attestation to", b.output)
+	}
+	tagged, attestationRef, err := attestationArtifactReference(dockerRef.String(), artifactType, subjectDigest)
+	if err != nil {
+		return nil, err
+	}
+	artifactDest, err := alltransports.ParseImageName(attestationRef)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing attestation artifact reference %q", attestationRef)
+	}
+
+	imgDest, err := artifactDest.NewImageDestination(ctx, b.systemContext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening destination for attestation artifact %q", attestationRef)
+	}
+	defer imgDest.Close()
+
+	cache := blobinfocache.DefaultCache(b.systemContext)
+	configDesc, err := pushAttestationBlob(ctx, imgDest, cache, emptyOCIConfig, v1.MediaTypeEmptyJSON, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error pushing attestation config blob")
+	}
+	artifactMediaType := fmt.Sprintf("application/vnd.buildah.attestation.%s.v1+json", artifactType)
+	layerDesc, err := pushAttestationBlob(ctx, imgDest, cache, document, artifactMediaType, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "error pushing attestation document blob")
+	}
+
+	artifactManifest := v1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactMediaType,
+		Config:       configDesc,
+		Layers:       []v1.Descriptor{layerDesc},
+		Subject: &v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    subjectDigest,
+			Size:      subjectSize,
+		},
+	}
+	manifestBytes, err := json.Marshal(artifactManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling attestation artifact manifest")
+	}
+	if err := imgDest.PutManifest(ctx, manifestBytes, nil); err != nil {
+		return nil, errors.Wrapf(err, "error pushing attestation artifact manifest to %q", attestationRef)
+	}
+	if b.signBy != "" {
+		if err := signImageDestination(ctx, imgDest, manifestBytes, b.signBy); err != nil {
+			return nil, errors.Wrapf(err, "error signing attestation artifact %q", attestationRef)
+		}
+	}
+	if err := imgDest.Commit(ctx, nil); err != nil {
+		return nil, errors.Wrapf(err, "error committing attestation artifact to %q", attestationRef)
+	}
+
+	canonical, err := reference.WithDigest(tagged, digest.FromBytes(manifestBytes))
+	if err != nil {
+		// The push already succeeded; not being able to describe it as a
+		// reference.Canonical isn't worth failing the build over.
+		logrus.Debugf("attestation: pushed %s to %s but couldn't build a canonical reference for it: %v", artifactType, attestationRef, err)
+		return nil, nil
+	}
+	return canonical, nil
+}
+
+// pushAttestationBlob pushes a single small blob (the empty config or the
+// attestation document itself) and returns its descriptor.
+func pushAttestationBlob(ctx context.Context, dest types.ImageDestination, cache types.BlobInfoCache, data []byte, mediaType string, isConfig bool) (v1.Descriptor, error) {
+	info := types.BlobInfo{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	newInfo, err := dest.PutBlob(ctx, bytes.NewReader(data), info, cache, isConfig)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: newInfo.Digest, Size: newInfo.Size}, nil
+}
+
+// signImageDestination signs manifestBytes, which was just pushed to dest,
+// with the GPG key identified by signBy, the same key Executor uses to sign
+// the image itself when SignBy is set.
+func signImageDestination(ctx context.Context, dest types.ImageDestination, manifestBytes []byte, signBy string) error {
+	dockerReference := dest.Reference().DockerReference()
+	if dockerReference == nil {
+		return errors.Errorf("%q can't be signed; it has no associated Docker reference", dest.Reference().StringWithinTransport())
+	}
+	mechanism, err := signature.NewGPGSigningMechanism()
+	if err != nil {
+		return errors.Wrap(err, "error initializing GPG signing mechanism")
+	}
+	defer mechanism.Close()
+	newSig, err := signature.SignDockerManifest(manifestBytes, dockerReference.String(), mechanism, signBy)
+	if err != nil {
+		return errors.Wrapf(err, "error signing manifest with key %q", signBy)
+	}
+	return dest.PutSignatures(ctx, [][]byte{newSig}, nil)
+}
+
+// imageManifestInfo reads back the manifest that was just pushed to ref, and
+// returns its digest and size, for use as the OCI 1.1 "subject" of an
+// attestation artifact.
+func (b *Executor) imageManifestInfo(ctx context.Context, ref types.ImageReference) (digest.Digest, int64, error) {
+	src, err := ref.NewImageSource(ctx, b.systemContext)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	manifestBytes, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	dgst, err := manifest.Digest(manifestBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	return dgst, int64(len(manifestBytes)), nil
+}
+
+// attestationArtifactReference builds the reference.NamedTagged and
+// corresponding docker:// reference string that an attestation artifact for
+// output/artifactType/subjectDigest is pushed to: the same repository as
+// output, tagged distinctly per artifact type and subject so that repeat
+// builds of the same image don't collide.
+func attestationArtifactReference(output, artifactType string, subjectDigest digest.Digest) (reference.NamedTagged, string, error) {
+	named, err := reference.ParseNormalizedNamed(output)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error parsing output image name %q", output)
+	}
+	tag := fmt.Sprintf("attestation-%s-%s", artifactType, subjectDigest.Encoded()[:12])
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error building attestation artifact reference for %q", output)
+	}
+	return tagged, "docker://" + tagged.String(), nil
+}
+
+// consumedArgs returns the subset of non-builtin build args that were
+// actually referenced by an ARG instruction somewhere in the build, i.e.
+// options.Args minus unusedArgs and minus builtinAllowedBuildArgs.
+func (b *Executor) consumedArgs() map[string]string {
+	consumed := make(map[string]string)
+	for arg, value := range b.args {
+		if builtinAllowedBuildArgs[arg] {
+			continue
+		}
+		if _, unused := b.unusedArgs[arg]; unused {
+			continue
+		}
+		consumed[arg] = value
+	}
+	return consumed
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
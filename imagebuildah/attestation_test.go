@@ -0,0 +1,91 @@
+package imagebuildah
+
+import (
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestConsumedArgsExcludesUnused(t *testing.T) {
+	b := &Executor{
+		args: map[string]string{"VERSION": "1.2.3", "UNUSED": "x"},
+		unusedArgs: map[string]struct{}{
+			"UNUSED": {},
+		},
+	}
+	consumed := b.consumedArgs()
+	if consumed["VERSION"] != "1.2.3" {
+		t.Fatalf("consumedArgs dropped a consumed arg: %#v", consumed)
+	}
+	if _, ok := consumed["UNUSED"]; ok {
+		t.Fatalf("consumedArgs kept an unused arg: %#v", consumed)
+	}
+}
+
+func TestFirstNonEmpty(t *testing.T) {
+	if got := firstNonEmpty("", "", "amd64"); got != "amd64" {
+		t.Fatalf("firstNonEmpty() = %q, want %q", got, "amd64")
+	}
+	if got := firstNonEmpty("arm64", "amd64"); got != "arm64" {
+		t.Fatalf("firstNonEmpty() = %q, want %q", got, "arm64")
+	}
+	if got := firstNonEmpty("", ""); got != "" {
+		t.Fatalf("firstNonEmpty() = %q, want empty", got)
+	}
+}
+
+func TestBuildProvenancePredicateIncludesResolvedMaterialDigests(t *testing.T) {
+	b := &Executor{
+		baseMap: map[string]digest.Digest{
+			"alpine:3.18": digest.FromString("alpine-manifest"),
+			"scratch-ish": "",
+		},
+		args:       map[string]string{},
+		unusedArgs: map[string]struct{}{},
+	}
+
+	predicate := b.buildProvenancePredicate(digest.FromString("dockerfile"))
+
+	found := make(map[string]string)
+	for _, m := range predicate.Materials {
+		found[m.URI] = m.Digest
+	}
+	if found["alpine:3.18"] != digest.FromString("alpine-manifest").String() {
+		t.Fatalf("material digest for resolved base not recorded: %#v", found)
+	}
+	if found["scratch-ish"] != "" {
+		t.Fatalf("material digest for unresolved base should be empty, got %q", found["scratch-ish"])
+	}
+	if predicate.Invocation.ConfigSource != digest.FromString("dockerfile").String() {
+		t.Fatalf("ConfigSource = %q, want the Dockerfile digest", predicate.Invocation.ConfigSource)
+	}
+}
+
+func TestRecordBaseDigestOnlyFillsKnownBases(t *testing.T) {
+	b := &Executor{baseMap: map[string]digest.Digest{"alpine:3.18": ""}}
+
+	b.recordBaseDigest("alpine:3.18", digest.FromString("resolved"))
+	if b.baseMap["alpine:3.18"] != digest.FromString("resolved") {
+		t.Fatalf("recordBaseDigest didn't fill in a known base")
+	}
+
+	b.recordBaseDigest("not-a-base", digest.FromString("resolved"))
+	if _, ok := b.baseMap["not-a-base"]; ok {
+		t.Fatalf("recordBaseDigest added an entry for a base it was never told about")
+	}
+}
+
+func TestAttestationArtifactReference(t *testing.T) {
+	dgst := digest.FromString("subject-manifest")
+	tagged, ref, err := attestationArtifactReference("quay.io/example/app:latest", "spdx", dgst)
+	if err != nil {
+		t.Fatalf("attestationArtifactReference: %v", err)
+	}
+	wantTag := "attestation-spdx-" + dgst.Encoded()[:12]
+	if tagged.Tag() != wantTag {
+		t.Fatalf("tag = %q, want %q", tagged.Tag(), wantTag)
+	}
+	if want := "docker://quay.io/example/app:" + wantTag; ref != want {
+		t.Fatalf("ref = %q, want %q", ref, want)
+	}
+}
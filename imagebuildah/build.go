@@ -0,0 +1,169 @@
+package imagebuildah
+
+import (
+	"io"
+	"time"
+
+	"github.com/containers/buildah"
+	"github.com/containers/image/v5/types"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/storage/pkg/archive"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Mount is a mount specification for a transient mount made available to
+// every stage of a build, such as a cache directory or a secret.
+type Mount specs.Mount
+
+// BuildOptions can be used to alter how a build is performed.
+type BuildOptions struct {
+	// ContextDirectory is the default source location for COPY and ADD
+	// commands that are found in the Dockerfile.
+	ContextDirectory string
+	// PullPolicy controls whether or not we pull images.  It should be one
+	// of PullIfMissing, PullAlways, PullIfNewer, or PullNever.
+	PullPolicy buildah.PullPolicy
+	// Registry is a value which is prepended to the image's name, if it
+	// needs to be pulled, before pulling the image.
+	Registry string
+	// IgnoreUnrecognizedInstructions tells us to just log instructions we
+	// don't recognize, and try to keep going.
+	IgnoreUnrecognizedInstructions bool
+	// Quiet tells us whether or not to announce each step we take.
+	Quiet bool
+	// Isolation controls how Run() runs things.
+	Isolation buildah.Isolation
+	// Runtime is the name of the command to run for RUN instructions when
+	// Isolation is either IsolationDefault or IsolationOCI.
+	Runtime string
+	// RuntimeArgs adds global arguments for the runtime.
+	RuntimeArgs []string
+	// TransientMounts is a list of mounts that won't be kept in the image.
+	TransientMounts []string
+	// Compression specifies the type of compression which is applied to
+	// layer blobs.
+	Compression archive.Compression
+	// Arguments which can be interpolated into Dockerfiles.
+	Args map[string]string
+	// Output is the name which should be assigned to the resulting image,
+	// if one is named.
+	Output string
+	// AdditionalTags is a list of additional names to add to the resulting
+	// image, if it's tagged in the usual sense.
+	AdditionalTags []string
+	// Log is a callback used to report build progress.
+	Log func(format string, args ...interface{})
+	// In, Out, and Err stream data from the build process.
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+	// SignaturePolicyPath specifies an override location for the signature
+	// policy which should be used for verifying the new image as it is
+	// being written.
+	SignaturePolicyPath string
+	// ReportWriter is an io.Writer to which a copy of the logged build
+	// progress will be written, if set.
+	ReportWriter io.Writer
+	// OutputFormat is the format of the output image's manifest and
+	// configuration data.
+	OutputFormat string
+	// SystemContext holds credentials and other configuration for
+	// contacting registries.
+	SystemContext *types.SystemContext
+	// NamespaceOptions controls how we set up namespaces for processes
+	// that we run in containers.
+	NamespaceOptions []buildah.NamespaceOption
+	// ConfigureNetwork controls whether or not network interfaces and
+	// routing are configured for a newly-created network namespace.
+	ConfigureNetwork buildah.NetworkConfigurationPolicy
+	CNIPluginPath    string
+	CNIConfigDir     string
+	// IDMappingOptions controls how we set up UID/GID mapping when we
+	// set up a user namespace.
+	IDMappingOptions *buildah.IDMappingOptions
+	// AddCapabilities is a list of capabilities to add to the default set
+	// when running commands in a container.
+	AddCapabilities []string
+	// DropCapabilities is a list of capabilities to remove from the
+	// default set when running commands in a container.
+	DropCapabilities []string
+	// CommonBuildOpts is an option used to hold the common options for
+	// containers.
+	CommonBuildOpts *buildah.CommonBuildOptions
+	// DefaultMountsFilePath is the file path holding the mounts to be
+	// mounted in "host-path:container-path" format.
+	DefaultMountsFilePath string
+	// IIDFile tells the builder to write the image ID to the named file.
+	IIDFile string
+	// Squash tells the builder to produce an image with a single layer
+	// instead of with possibly more than one layer.
+	Squash bool
+	// Labels metadata for an image.
+	Labels []string
+	// Annotation metadata for an image.
+	Annotations []string
+	// Layers tells the builder to create a cache of images for each step
+	// in the Dockerfile.
+	Layers bool
+	// NoCache tells the builder to build the image from scratch without
+	// checking for a cache.
+	NoCache bool
+	// RemoveIntermediateCtrs tells the builder whether to remove
+	// intermediate containers used during the build process.
+	RemoveIntermediateCtrs bool
+	// ForceRmIntermediateCtrs tells the builder to remove all the
+	// intermediate containers, even if a build was unsuccessful.
+	ForceRmIntermediateCtrs bool
+	// BlobDirectory is a directory which we'll use for caching layer blobs.
+	BlobDirectory string
+	// Devices are additional devices to add to the containers.
+	Devices []string
+	// SignBy is the fingerprint of a GPG key to use for signing images.
+	SignBy string
+	// Architecture specifies the target architecture of the image to be
+	// built.
+	Architecture string
+	// OS specifies the target operating system of the image to be built.
+	OS string
+	// MaxPullPushRetries is the maximum number of attempts we'll make to
+	// pull or push any one image.
+	MaxPullPushRetries int
+	// PullPushRetryDelay is how long to wait before retrying a pull or
+	// push attempt.
+	PullPushRetryDelay time.Duration
+	// OciDecryptConfig contains the config that can be used to decrypt an
+	// image if it's encrypted.
+	OciDecryptConfig *encconfig.DecryptConfig
+	// Jobs is how many stages, or instructions within stages, we're
+	// willing to run in parallel.
+	Jobs int
+	// CacheFrom is the name of a container registry repository that holds
+	// previously-pushed per-instruction layer caches which should be
+	// consulted before running an instruction.  The local store is not
+	// searched for per-instruction layer caches.
+	CacheFrom string
+	// CacheTo is the name of a container registry repository that
+	// per-instruction layer caches should be pushed to after each
+	// instruction finishes, so that a later build, possibly on a
+	// different host, can reuse them.
+	CacheTo string
+	// GlobalCacheVersion is mixed into every cache key computed for
+	// CacheFrom/CacheTo, including the key used to look up the FROM
+	// instruction's base image.  Changing it invalidates the entire
+	// remote cache.
+	GlobalCacheVersion string
+	// EventChannel, if set, receives a BuildEvent for each notable thing
+	// that happens over the course of the build, so that callers can
+	// render progress or timing without scraping the Log output.  Sends
+	// are non-blocking: a caller that isn't keeping up with the channel
+	// will simply miss events rather than stall the build.
+	EventChannel chan<- BuildEvent
+	// SBOMGenerators, if set, are run against the final stage's rootfs
+	// after it's committed, and their output is attached to the built
+	// image as attestations.
+	SBOMGenerators []SBOMGenerator
+	// EmitProvenance tells Build to synthesize an in-toto/SLSA-style
+	// provenance predicate for the build and attach it as an attestation
+	// alongside any SBOMGenerators output.
+	EmitProvenance bool
+}
@@ -0,0 +1,61 @@
+package imagebuildah
+
+import "testing"
+
+func TestCacheDigestDeterministic(t *testing.T) {
+	a := cacheDigest("parent", "ingredient")
+	b := cacheDigest("parent", "ingredient")
+	if a != b {
+		t.Fatalf("cacheDigest is not deterministic: %q != %q", a, b)
+	}
+}
+
+func TestCacheDigestDistinguishesInputs(t *testing.T) {
+	cases := []struct{ parent, ingredient string }{
+		{"parent", "ingredient"},
+		{"parent", "other"},
+		{"other", "ingredient"},
+		{"", "parentingredient"},
+		{"parentingredient", ""},
+	}
+	seen := make(map[string]bool)
+	for _, c := range cases {
+		key := cacheDigest(c.parent, c.ingredient)
+		if seen[key] {
+			t.Fatalf("cacheDigest(%q, %q) collided with an earlier case: %q", c.parent, c.ingredient, key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestStageExecutorCacheKeyChaining(t *testing.T) {
+	s := &StageExecutor{executor: &Executor{globalCacheVersion: "v1"}}
+
+	seed := s.seedCacheKey("FROM base")
+	if seed != s.cacheKey {
+		t.Fatalf("seedCacheKey didn't record its result as the current key")
+	}
+
+	next := s.nextCacheKey("RUN echo hi")
+	if next != s.cacheKey {
+		t.Fatalf("nextCacheKey didn't record its result as the current key")
+	}
+	if next == seed {
+		t.Fatalf("nextCacheKey returned the same key as seedCacheKey")
+	}
+
+	// Chaining the same instruction onto the same seed is deterministic.
+	other := &StageExecutor{executor: &Executor{globalCacheVersion: "v1"}}
+	other.seedCacheKey("FROM base")
+	if other.nextCacheKey("RUN echo hi") != next {
+		t.Fatalf("nextCacheKey isn't deterministic given the same seed and instruction")
+	}
+}
+
+func TestCacheReference(t *testing.T) {
+	got := cacheReference("quay.io/example/cache", "build", 3, "abc123")
+	want := "docker://quay.io/example/cache:stage-build-inst-3-abc123"
+	if got != want {
+		t.Fatalf("cacheReference() = %q, want %q", got, want)
+	}
+}
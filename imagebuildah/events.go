@@ -0,0 +1,109 @@
+package imagebuildah
+
+import "time"
+
+// BuildEvent is implemented by every event that an Executor can emit on
+// BuildOptions.EventChannel.  Consumers should type-switch on the concrete
+// event types below; the set is expected to grow over time, so switches
+// should have a default case.
+type BuildEvent interface {
+	isBuildEvent()
+}
+
+// StageStarted is emitted when a stage is about to start, before its build
+// container is created.
+type StageStarted struct {
+	Index int
+	Name  string
+	Base  string
+}
+
+// StepStarted is emitted immediately before an instruction runs.
+type StepStarted struct {
+	Stage       string
+	Index       int
+	Instruction string
+	Command     string
+}
+
+// StepCacheHit is emitted instead of StepCommitted when an instruction was
+// satisfied from the CacheFrom repository rather than actually executed.
+// The local store is not searched for cached layers.
+type StepCacheHit struct {
+	Stage   string
+	Index   int
+	ImageID string
+}
+
+// StepCommitted is emitted after an instruction runs and its result is
+// committed to a new layer.
+type StepCommitted struct {
+	Stage    string
+	Index    int
+	ImageID  string
+	DiffID   string
+	Size     int64
+	Duration time.Duration
+}
+
+// StageFinished is emitted once a stage has produced its final image (or
+// failed); Err is non-nil only in the failure case.
+type StageFinished struct {
+	Stage   string
+	ImageID string
+	Err     error
+}
+
+// PullProgress is emitted periodically while a layer cache image is being
+// pulled from the CacheFrom repository.  Base images pulled while creating
+// a stage's build container do not produce PullProgress events.
+type PullProgress struct {
+	Ref     string
+	Current int64
+	Total   int64
+}
+
+// PushProgress is emitted periodically while a layer cache image is being
+// pushed to the CacheTo repository.  Pushes of the final image and of
+// attestation artifacts do not produce PushProgress events.
+type PushProgress struct {
+	Ref     string
+	Current int64
+	Total   int64
+}
+
+func (StageStarted) isBuildEvent()  {}
+func (StepStarted) isBuildEvent()   {}
+func (StepCacheHit) isBuildEvent()  {}
+func (StepCommitted) isBuildEvent() {}
+func (StageFinished) isBuildEvent() {}
+func (PullProgress) isBuildEvent()  {}
+func (PushProgress) isBuildEvent()  {}
+
+// emit adapts ev onto the legacy log callback for backward compatibility,
+// then forwards it to EventChannel, if one was configured.  A full channel
+// drops the event rather than stalling the build; EventChannel is meant for
+// progress reporting, not a guaranteed delivery log.
+func (b *Executor) emit(ev BuildEvent) {
+	b.logEvent(ev)
+	if b.eventChannel == nil {
+		return
+	}
+	select {
+	case b.eventChannel <- ev:
+	default:
+	}
+}
+
+// logEvent renders the subset of events that used to have their own
+// "STEP N: ..."-style log line through the log callback, so that callers
+// which only know about BuildOptions.Log keep seeing the same output they
+// always have.
+func (b *Executor) logEvent(ev BuildEvent) {
+	switch e := ev.(type) {
+	case StepStarted:
+		b.log("%s", e.Command)
+	case StepCacheHit:
+		b.log("--> Using cache %s", e.ImageID)
+	}
+}
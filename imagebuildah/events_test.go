@@ -0,0 +1,51 @@
+package imagebuildah
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmitForwardsToEventChannel(t *testing.T) {
+	ch := make(chan BuildEvent, 1)
+	b := &Executor{log: func(string, ...interface{}) {}, eventChannel: ch}
+
+	ev := StageStarted{Index: 0, Name: "builder", Base: "alpine"}
+	b.emit(ev)
+
+	select {
+	case got := <-ch:
+		if got != BuildEvent(ev) {
+			t.Fatalf("emit sent %#v, want %#v", got, ev)
+		}
+	default:
+		t.Fatalf("emit didn't forward the event to eventChannel")
+	}
+}
+
+func TestEmitDoesNotBlockOnFullChannel(t *testing.T) {
+	ch := make(chan BuildEvent) // unbuffered and nobody's reading
+	b := &Executor{log: func(string, ...interface{}) {}, eventChannel: ch}
+
+	done := make(chan struct{})
+	go func() {
+		b.emit(StepStarted{Stage: "builder", Index: 0})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("emit blocked on a full/unread eventChannel instead of dropping the event")
+	}
+}
+
+func TestEmitWithoutEventChannelStillLogs(t *testing.T) {
+	var logged string
+	b := &Executor{log: func(format string, args ...interface{}) { logged = format }}
+
+	b.emit(StepStarted{Stage: "builder", Index: 0, Command: "RUN true"})
+
+	if logged == "" {
+		t.Fatalf("emit with no eventChannel didn't invoke the legacy log callback")
+	}
+}
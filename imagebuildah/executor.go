@@ -24,13 +24,13 @@ import (
 	encconfig "github.com/containers/ocicrypt/config"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	"github.com/openshift/imagebuilder"
 	"github.com/openshift/imagebuilder/dockerfile/parser"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/semaphore"
 )
 
 // builtinAllowedBuildArgs is list of built-in allowed build args.  Normally we
@@ -91,7 +91,7 @@ type Executor struct {
 	forceRmIntermediateCtrs        bool
 	imageMap                       map[string]string           // Used to map images that we create to handle the AS construct.
 	containerMap                   map[string]*buildah.Builder // Used to map from image names to only-created-for-the-rootfs containers.
-	baseMap                        map[string]bool             // Holds the names of every base image, as given.
+	baseMap                        map[string]digest.Digest    // Holds the names of every base image, as given, mapped to its resolved manifest digest once known.
 	rootfsMap                      map[string]bool             // Holds the names of every stage whose rootfs is referenced in a COPY or ADD instruction.
 	blobDirectory                  string
 	excludes                       []string
@@ -105,10 +105,18 @@ type Executor struct {
 	retryPullPushDelay             time.Duration
 	ociDecryptConfig               *encconfig.DecryptConfig
 	lastError                      error
-	terminatedStage                map[string]struct{}
 	stagesLock                     sync.Mutex
-	stagesSemaphore                *semaphore.Weighted
+	stageGraph                     *stageGraph
 	jobs                           int
+	cacheFrom                      string
+	cacheTo                        string
+	globalCacheVersion             string
+	eventChannel                   chan<- BuildEvent
+	args                           map[string]string
+	sbomGenerators                 []SBOMGenerator
+	emitProvenance                 bool
+	stageTimings                   map[string]stageTiming
+	dockerfileDigest               digest.Digest
 }
 
 // NewExecutor creates a new instance of the imagebuilder.Executor interface.
@@ -186,7 +194,7 @@ func NewExecutor(store storage.Store, options BuildOptions, mainNode *parser.Nod
 		forceRmIntermediateCtrs:        options.ForceRmIntermediateCtrs,
 		imageMap:                       make(map[string]string),
 		containerMap:                   make(map[string]*buildah.Builder),
-		baseMap:                        make(map[string]bool),
+		baseMap:                        make(map[string]digest.Digest),
 		rootfsMap:                      make(map[string]bool),
 		blobDirectory:                  options.BlobDirectory,
 		unusedArgs:                     make(map[string]struct{}),
@@ -198,8 +206,14 @@ func NewExecutor(store storage.Store, options BuildOptions, mainNode *parser.Nod
 		maxPullPushRetries:             options.MaxPullPushRetries,
 		retryPullPushDelay:             options.PullPushRetryDelay,
 		ociDecryptConfig:               options.OciDecryptConfig,
-		terminatedStage:                make(map[string]struct{}),
 		jobs:                           options.Jobs,
+		cacheFrom:                      options.CacheFrom,
+		cacheTo:                        options.CacheTo,
+		globalCacheVersion:             options.GlobalCacheVersion,
+		eventChannel:                   options.EventChannel,
+		args:                           options.Args,
+		sbomGenerators:                 options.SBOMGenerators,
+		emitProvenance:                 options.EmitProvenance,
 	}
 	if exec.err == nil {
 		exec.err = os.Stderr
@@ -240,6 +254,14 @@ func NewExecutor(store storage.Store, options BuildOptions, mainNode *parser.Nod
 			break
 		}
 	}
+
+	var dockerfileContent strings.Builder
+	for _, line := range mainNode.Children {
+		dockerfileContent.WriteString(line.Original)
+		dockerfileContent.WriteString("\n")
+	}
+	exec.dockerfileDigest = digest.FromString(dockerfileContent.String())
+
 	return &exec, nil
 }
 
@@ -266,6 +288,66 @@ func (b *Executor) startStage(stage *imagebuilder.Stage, stages int, output stri
 	return stageExec
 }
 
+// lookupStageImage returns the image ID that an earlier stage named name
+// produced, if any, guarding the read against the concurrent writes that
+// Build's per-stage goroutines make to imageMap as stages finish.
+func (b *Executor) lookupStageImage(name string) (string, bool) {
+	b.stagesLock.Lock()
+	defer b.stagesLock.Unlock()
+	id, ok := b.imageMap[name]
+	return id, ok
+}
+
+// recordBaseDigest fills in the resolved manifest digest for a named base
+// image, for the benefit of the provenance predicate's materials list.  It's
+// a no-op for bases this build never saw in a FROM (e.g. the name it's
+// called with is a resolved stage reference, not a named base image).
+func (b *Executor) recordBaseDigest(base string, dgst digest.Digest) {
+	if dgst == "" {
+		return
+	}
+	b.stagesLock.Lock()
+	defer b.stagesLock.Unlock()
+	if _, ok := b.baseMap[base]; ok {
+		b.baseMap[base] = dgst
+	}
+}
+
+// mountStageOrImage returns the rootfs mountpoint to read from for a
+// COPY/ADD --from=<ref>: if ref names an earlier stage, that stage's own
+// build container is reused; otherwise ref is treated as an image reference,
+// and a throwaway container is created (and cached in containerMap, to be
+// cleaned up by Build) purely to read its filesystem.
+func (b *Executor) mountStageOrImage(ctx context.Context, ref string) (string, error) {
+	b.stagesLock.Lock()
+	stage, isStage := b.stages[ref]
+	b.stagesLock.Unlock()
+	if isStage && stage.builder != nil {
+		return stage.builder.Mount("")
+	}
+
+	b.stagesLock.Lock()
+	builder, cached := b.containerMap[ref]
+	b.stagesLock.Unlock()
+	if !cached {
+		var err error
+		builder, err = buildah.NewBuilder(ctx, b.store, buildah.BuilderOptions{
+			FromImage:           ref,
+			PullPolicy:          b.pullPolicy,
+			Registry:            b.registry,
+			SystemContext:       b.systemContext,
+			SignaturePolicyPath: b.signaturePolicyPath,
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "error resolving --from=%q", ref)
+		}
+		b.stagesLock.Lock()
+		b.containerMap[ref] = builder
+		b.stagesLock.Unlock()
+	}
+	return builder.Mount("")
+}
+
 // resolveNameToImageRef creates a types.ImageReference for the output name in local storage
 func (b *Executor) resolveNameToImageRef(output string) (types.ImageReference, error) {
 	imageRef, err := alltransports.ParseImageName(output)
@@ -286,33 +368,33 @@ func (b *Executor) resolveNameToImageRef(output string) (types.ImageReference, e
 	return imageRef, nil
 }
 
+// waitForStage blocks until the named stage has finished building (whether
+// it succeeded or failed), without holding a worker slot while it waits.
 func (b *Executor) waitForStage(ctx context.Context, name string) error {
-	stage := b.stages[name]
-	if stage == nil {
+	node, ok := b.stageGraph.nodes[name]
+	if !ok {
 		return errors.Errorf("unknown stage %q", name)
 	}
-	for {
-		if b.lastError != nil {
-			return b.lastError
-		}
-		if stage.stage == nil {
-			return nil
-		}
-
-		b.stagesLock.Lock()
-		_, terminated := b.terminatedStage[name]
-		b.stagesLock.Unlock()
-
-		if terminated {
-			return nil
-		}
+	select {
+	case <-node.done:
+		return node.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		b.stagesSemaphore.Release(1)
-		time.Sleep(time.Millisecond * 10)
-		if err := b.stagesSemaphore.Acquire(ctx, 1); err != nil {
-			return err
-		}
+// imageDigestByID returns the manifest digest that local storage recorded
+// for imageID when it was pulled or committed, if any.
+func (b *Executor) imageDigestByID(id string) (digest.Digest, error) {
+	ref, err := is.Transport.ParseStoreReference(b.store, "@"+id)
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting image reference %q", id)
 	}
+	img, err := is.Transport.GetStoreImage(b.store, ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "error looking up image %q", id)
+	}
+	return img.Digest, nil
 }
 
 // getImageHistory returns the history of imageID.
@@ -363,10 +445,17 @@ func (b *Executor) buildStage(ctx context.Context, cleanupStages map[int]*StageE
 		b.stagesLock.Unlock()
 	}
 
+	b.emit(StageStarted{Index: stageIndex, Name: stage.Name, Base: base})
+
 	// Build this stage.
+	started := time.Now()
 	if imageID, ref, err = stageExecutor.Execute(ctx, base); err != nil {
+		b.emit(StageFinished{Stage: stage.Name, Err: err})
+		b.recordStageTiming(stage.Name, started, time.Now())
 		return "", nil, err
 	}
+	b.recordStageTiming(stage.Name, started, time.Now())
+	b.emit(StageFinished{Stage: stage.Name, ImageID: imageID})
 
 	// The stage succeeded, so remove its build container if we're
 	// told to delete successful intermediate/build containers for
@@ -382,10 +471,12 @@ func (b *Executor) buildStage(ctx context.Context, cleanupStages map[int]*StageE
 
 // Build takes care of the details of running Prepare/Execute/Commit/Delete
 // over each of the one or more parsed Dockerfiles and stages.
-func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (imageID string, ref reference.Canonical, err error) {
+func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (result *BuildResult, err error) {
 	if len(stages) == 0 {
-		return "", nil, errors.New("error building: no stages to build")
+		return nil, errors.New("error building: no stages to build")
 	}
+	var imageID string
+	var ref reference.Canonical
 	var cleanupImages []string
 	cleanupStages := make(map[int]*StageExecutor)
 
@@ -471,7 +562,12 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 							// expansion, so if the AS clause in another
 							// FROM instruction uses argument values,
 							// we might not record the right value here.
-							b.baseMap[base] = true
+							// Its digest isn't known yet; recordBaseDigest
+							// fills it in once the stage that uses this
+							// base actually resolves it.
+							if _, recorded := b.baseMap[base]; !recorded {
+								b.baseMap[base] = ""
+							}
 							logrus.Debugf("base: %q", base)
 						}
 					}
@@ -500,80 +596,105 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 		Error   error
 	}
 
-	ch := make(chan Result)
+	// Buffered so that a stage goroutine can always report its result and
+	// exit even after the loop below has already returned on an earlier
+	// stage's error; otherwise those goroutines, and the worker slots
+	// they're holding, would leak for the rest of the process's life.
+	ch := make(chan Result, len(stages))
+
+	graph, err := b.buildStageGraph(stages)
+	if err != nil {
+		return nil, err
+	}
+	b.stageGraph = graph
 
-	jobs := int64(b.jobs)
+	jobs := b.jobs
 	if jobs < 0 {
-		return "", nil, errors.New("error building: invalid value for jobs.  It must be a positive integer")
+		return nil, errors.New("error building: invalid value for jobs.  It must be a positive integer")
 	} else if jobs == 0 {
-		jobs = int64(len(stages))
+		jobs = len(stages)
 	}
-
-	b.stagesSemaphore = semaphore.NewWeighted(jobs)
+	workers := make(chan struct{}, jobs)
 
 	var wg sync.WaitGroup
 	wg.Add(len(stages))
 
-	go func() {
-		for stageIndex := range stages {
-			index := stageIndex
-			// Acquire the sempaphore before creating the goroutine so we are sure they
-			// run in the specified order.
-			if err := b.stagesSemaphore.Acquire(ctx, 1); err != nil {
-				b.lastError = err
-				return
-			}
-			go func() {
-				defer b.stagesSemaphore.Release(1)
-				defer wg.Done()
-				imageID, ref, err = b.buildStage(ctx, cleanupStages, stages, index)
-				if err != nil {
-					ch <- Result{
-						Index: index,
-						Error: err,
-					}
+	for stageIndex := range stages {
+		index := stageIndex
+		stage := stages[index]
+		node := graph.nodes[stage.Name]
+		go func() {
+			defer wg.Done()
+			defer close(node.done)
+
+			// Block on our parent stages finishing, without tying up a
+			// worker slot while we wait, so independent branches of the
+			// build can make progress concurrently.
+			for _, parent := range node.parents {
+				if err := b.waitForStage(ctx, parent); err != nil {
+					node.err = err
+					ch <- Result{Index: index, Error: err}
 					return
 				}
+			}
 
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			stageImageID, stageRef, err := b.buildStage(ctx, cleanupStages, stages, index)
+			if err != nil {
+				node.err = err
 				ch <- Result{
-					Index:   index,
-					ImageID: imageID,
-					Ref:     ref,
-					Error:   nil,
+					Index: index,
+					Error: err,
 				}
-			}()
-		}
-	}()
+				return
+			}
+
+			// Record the image we just produced in imageMap *before*
+			// node.done is closed (by the deferred close above), so that a
+			// dependent stage unblocked by waitForStage can never observe
+			// node.done closed without also seeing its entry in imageMap.
+			// Doing this in the consumer loop below instead would race:
+			// ch is buffered, so the send doesn't wait for that loop to
+			// dequeue it, and a child stage could look itself up as an
+			// external image reference in the window before it did.
+			if index < len(stages)-1 && stageImageID != "" {
+				b.stagesLock.Lock()
+				b.imageMap[stage.Name] = stageImageID
+				if idx := strconv.Itoa(index); idx != stage.Name {
+					b.imageMap[idx] = stageImageID
+				}
+				b.stagesLock.Unlock()
+			}
+
+			ch <- Result{
+				Index:   index,
+				ImageID: stageImageID,
+				Ref:     stageRef,
+				Error:   nil,
+			}
+		}()
+	}
 	go func() {
 		wg.Wait()
 		close(ch)
 	}()
 
 	for r := range ch {
-		stage := stages[r.Index]
-
-		b.stagesLock.Lock()
-		b.terminatedStage[stage.Name] = struct{}{}
-		b.stagesLock.Unlock()
-
 		if r.Error != nil {
 			b.lastError = r.Error
-			return "", nil, r.Error
+			return nil, r.Error
 		}
 
-		// If this is an intermediate stage, make a note of the ID, so
-		// that we can look it up later.
-		if r.Index < len(stages)-1 && r.ImageID != "" {
-			b.imageMap[stage.Name] = r.ImageID
-			// We're not populating the cache with intermediate
-			// images, so add this one to the list of images that
-			// we'll remove later.
-			if !b.layers {
-				cleanupImages = append(cleanupImages, r.ImageID)
-			}
+		// imageMap was already updated by the producer goroutine, before
+		// it sent us this result; here we just track what to clean up.
+		if r.Index < len(stages)-1 && r.ImageID != "" && !b.layers {
+			cleanupImages = append(cleanupImages, r.ImageID)
 		}
 		if r.Index == len(stages)-1 {
 			imageID = r.ImageID
+			ref = r.Ref
 		}
 	}
 
@@ -592,10 +713,10 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 			case is.Transport.Name():
 				img, err := is.Transport.GetStoreImage(b.store, dest)
 				if err != nil {
-					return imageID, ref, errors.Wrapf(err, "error locating just-written image %q", transports.ImageName(dest))
+					return &BuildResult{ImageID: imageID, Ref: ref}, errors.Wrapf(err, "error locating just-written image %q", transports.ImageName(dest))
 				}
 				if err = util.AddImageNames(b.store, "", b.systemContext, img, b.additionalTags); err != nil {
-					return imageID, ref, errors.Wrapf(err, "error setting image names to %v", append(img.Names, b.additionalTags...))
+					return &BuildResult{ImageID: imageID, Ref: ref}, errors.Wrapf(err, "error setting image names to %v", append(img.Names, b.additionalTags...))
 				}
 				logrus.Debugf("assigned names %v to image %q", img.Names, img.ID)
 			default:
@@ -604,20 +725,25 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 		}
 	}
 
+	attestations, err := b.attestFinalImage(ctx, b.dockerfileDigest, stages, imageID)
+	if err != nil {
+		return &BuildResult{ImageID: imageID, Ref: ref}, errors.Wrapf(err, "error generating attestations for %q", imageID)
+	}
+
 	if err := cleanup(); err != nil {
-		return "", nil, err
+		return nil, err
 	}
 	logrus.Debugf("printing final image id %q", imageID)
 	if b.iidfile != "" {
 		if err = ioutil.WriteFile(b.iidfile, []byte(imageID), 0644); err != nil {
-			return imageID, ref, errors.Wrapf(err, "failed to write image ID to file %q", b.iidfile)
+			return &BuildResult{ImageID: imageID, Ref: ref, Attestations: attestations}, errors.Wrapf(err, "failed to write image ID to file %q", b.iidfile)
 		}
 	} else {
 		if _, err := stdout.Write([]byte(imageID + "\n")); err != nil {
-			return imageID, ref, errors.Wrapf(err, "failed to write image ID to stdout")
+			return &BuildResult{ImageID: imageID, Ref: ref, Attestations: attestations}, errors.Wrapf(err, "failed to write image ID to stdout")
 		}
 	}
-	return imageID, ref, nil
+	return &BuildResult{ImageID: imageID, Ref: ref, Attestations: attestations}, nil
 }
 
 // deleteSuccessfulIntermediateCtrs goes through the container IDs in each
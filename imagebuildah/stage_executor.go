@@ -0,0 +1,328 @@
+package imagebuildah
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/buildah"
+	"github.com/containers/buildah/docker"
+	"github.com/containers/image/v5/docker/reference"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// StageExecutor bundles up what we need to know when executing one stage of
+// a (possibly multi-stage) build.
+type StageExecutor struct {
+	executor        *Executor
+	index           int
+	stages          int
+	name            string
+	builder         *buildah.Builder
+	volumeCache     map[string]string
+	volumeCacheInfo map[string]os.FileInfo
+	output          string
+	containerIDs    []string
+	stage           *imagebuilder.Stage
+
+	// ctx is the context of the Execute call currently in progress; it's
+	// stashed here because imagebuilder.Executor's callback methods
+	// (Copy, Run, ...) don't take one of their own.
+	ctx context.Context
+
+	// cacheKey is the cache key computed for the most recently executed
+	// instruction in this stage; it seeds the key for the next one.
+	cacheKey string
+}
+
+// Delete removes the working container, if we have one, for this stage.
+func (s *StageExecutor) Delete() error {
+	if s.builder != nil {
+		err := s.builder.Delete()
+		s.builder = nil
+		return err
+	}
+	return nil
+}
+
+// Execute runs through this stage's instructions, one at a time, starting
+// from the given base image (or "" / "scratch"), and returns the ID and
+// canonical reference of the image that the stage produced.
+func (s *StageExecutor) Execute(ctx context.Context, base string) (imageID string, ref reference.Canonical, err error) {
+	executor := s.executor
+
+	// If base names an earlier stage (by AS name or positional index),
+	// build on top of the image that stage already produced instead of
+	// trying to pull it; that image only exists in local storage, under
+	// an ID, so neither the stage name itself nor a remote cache lookup
+	// for it means anything.
+	resolvedBase := base
+	fromStage := false
+	if stageImageID, ok := executor.lookupStageImage(base); ok {
+		resolvedBase = "@" + stageImageID
+		fromStage = true
+	}
+
+	// The FROM instruction participates in caching just like any other
+	// instruction: if a previous build already pushed a cached layer for
+	// this exact base (mixed with GlobalCacheVersion), reuse it instead of
+	// repulling/recreating the base container.  This also ensures that a
+	// stage which consists of nothing but a FROM still gets a cache key
+	// recorded, instead of being skipped entirely.
+	s.seedCacheKey("FROM " + base)
+	if !fromStage {
+		if hitID, ok := s.checkCache(ctx, -1, s.cacheKey); ok {
+			resolvedBase = "@" + hitID
+		}
+	}
+
+	builder, err := buildah.NewBuilder(ctx, executor.store, buildah.BuilderOptions{
+		FromImage:             resolvedBase,
+		PullPolicy:            executor.pullPolicy,
+		Registry:              executor.registry,
+		SignaturePolicyPath:   executor.signaturePolicyPath,
+		SystemContext:         executor.systemContext,
+		Isolation:             executor.isolation,
+		NamespaceOptions:      executor.namespaceOptions,
+		ConfigureNetwork:      executor.configureNetwork,
+		CNIPluginPath:         executor.cniPluginPath,
+		CNIConfigDir:          executor.cniConfigDir,
+		IDMappingOptions:      executor.idmappingOptions,
+		CommonBuildOpts:       executor.commonBuildOptions,
+		DefaultMountsFilePath: executor.defaultMountsFilePath,
+		Capabilities:          executor.capabilities,
+		Devices:               executor.devices,
+		MaxPullRetries:        executor.maxPullPushRetries,
+		PullRetryDelay:        executor.retryPullPushDelay,
+		OciDecryptConfig:      executor.ociDecryptConfig,
+	})
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error creating build container for stage %q", s.name)
+	}
+	s.builder = builder
+	s.containerIDs = append(s.containerIDs, builder.ContainerID)
+	if !fromStage && resolvedBase == base {
+		// We didn't have a cached base to fall back on, so record the one
+		// we actually resolved for the benefit of the next build.
+		s.populateCache(ctx, -1, s.cacheKey, builder.FromImageID)
+	}
+	if !fromStage {
+		if dgst, err := executor.imageDigestByID(builder.FromImageID); err != nil {
+			logrus.Debugf("provenance: couldn't resolve digest of base %q: %v", base, err)
+		} else {
+			executor.recordBaseDigest(base, dgst)
+		}
+	}
+
+	node := s.stage.Node
+	children := node.Children
+	for index, child := range children {
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		default:
+		}
+
+		key := s.nextCacheKey(child.Original)
+
+		executor.emit(StepStarted{Stage: s.name, Index: index, Instruction: child.Value, Command: child.Original})
+
+		if hitID, ok := s.checkCache(ctx, index, key); ok {
+			executor.emit(StepCacheHit{Stage: s.name, Index: index, ImageID: hitID})
+			imageID = hitID
+			continue
+		}
+
+		start := time.Now()
+		commitID, commitErr := s.run(ctx, builder, child)
+		if commitErr != nil {
+			return "", nil, errors.Wrapf(commitErr, "error building at step %d: %q", index, child.Original)
+		}
+		imageID = commitID
+
+		s.populateCache(ctx, index, key, commitID)
+		diffID, size := s.layerInfo(commitID)
+		executor.emit(StepCommitted{Stage: s.name, Index: index, ImageID: commitID, DiffID: diffID, Size: size, Duration: time.Since(start)})
+	}
+
+	if s.output != "" {
+		finalID, committedRef, commitErr := s.commitFinal(ctx, builder, s.output)
+		if commitErr != nil {
+			return "", nil, commitErr
+		}
+		imageID = finalID
+		ref = committedRef
+	}
+
+	return imageID, ref, nil
+}
+
+// run executes a single instruction node against the stage's build
+// container and commits the result.  The node is handed to imagebuilder's
+// own dispatcher, which parses out what the instruction means and calls
+// back into the StageExecutor (acting as the imagebuilder.Executor it
+// needs) to actually run it: Copy for COPY/ADD, Run for RUN, and so on.
+func (s *StageExecutor) run(ctx context.Context, builder *buildah.Builder, node *parser.Node) (string, error) {
+	s.ctx = ctx
+	if err := s.stage.Builder.Run(node, s); err != nil {
+		return "", err
+	}
+	imageID, _, _, err := builder.Commit(ctx, nil, buildah.CommitOptions{
+		SystemContext: s.executor.systemContext,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error committing container for step %q", node.Original)
+	}
+	return imageID, nil
+}
+
+// Copy implements imagebuilder.Executor: it's called once per COPY/ADD
+// instruction, with sources, destination, and flags already parsed out of
+// the instruction node by imagebuilder.
+func (s *StageExecutor) Copy(excludes []string, copies ...imagebuilder.Copy) error {
+	for _, cp := range copies {
+		contextDir := s.executor.contextDir
+		if cp.From != "" {
+			mountpoint, err := s.executor.mountStageOrImage(s.ctx, cp.From)
+			if err != nil {
+				return errors.Wrapf(err, "error resolving --from=%q", cp.From)
+			}
+			contextDir = mountpoint
+		}
+		if err := s.builder.Add(cp.Dest, cp.Download, buildah.AddAndCopyOptions{
+			Chown:      cp.Chown,
+			ContextDir: contextDir,
+			Excludes:   excludes,
+		}, cp.Src...); err != nil {
+			return errors.Wrapf(err, "error adding sources %v to %q", cp.Src, cp.Dest)
+		}
+	}
+	return nil
+}
+
+// Run implements imagebuilder.Executor: it's called for a RUN instruction,
+// with config carrying the ENV/WORKDIR/USER state imagebuilder has
+// accumulated for the stage so far.
+func (s *StageExecutor) Run(run imagebuilder.Run, config docker.Config) error {
+	args := append([]string{}, run.Args...)
+	if run.Shell {
+		args = []string{"/bin/sh", "-c", strings.Join(args, " ")}
+	}
+
+	mounts := make([]specs.Mount, len(s.executor.transientMounts))
+	for i, m := range s.executor.transientMounts {
+		mounts[i] = specs.Mount(m)
+	}
+
+	return s.builder.Run(args, buildah.RunOptions{
+		Env:              config.Env,
+		WorkingDir:       config.WorkingDir,
+		User:             config.User,
+		Isolation:        s.executor.isolation,
+		NamespaceOptions: s.executor.namespaceOptions,
+		ConfigureNetwork: s.executor.configureNetwork,
+		CNIPluginPath:    s.executor.cniPluginPath,
+		CNIConfigDir:     s.executor.cniConfigDir,
+		Runtime:          s.executor.runtime,
+		Args:             s.executor.runtimeArgs,
+		Mounts:           mounts,
+		Stdin:            s.executor.in,
+		Stdout:           s.executor.out,
+		Stderr:           s.executor.err,
+		Quiet:            s.executor.quiet,
+	})
+}
+
+// UnrecognizedInstruction implements imagebuilder.Executor: it's called for
+// any instruction imagebuilder's dispatcher doesn't know how to run itself.
+func (s *StageExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error {
+	if s.executor.ignoreUnrecognizedInstructions {
+		logrus.Debugf("ignoring unrecognized instruction: %q", step.Original)
+		return nil
+	}
+	return errors.Errorf("build error: unrecognized instruction: %q", step.Original)
+}
+
+// Preserve implements imagebuilder.Executor: it's called for each path named
+// by a VOLUME instruction, so that path can be remembered and restored after
+// a later instruction that might otherwise shadow it.
+func (s *StageExecutor) Preserve(path string) error {
+	if _, ok := s.volumeCache[path]; ok {
+		return nil
+	}
+	mountpoint, err := s.builder.Mount("")
+	if err != nil {
+		return errors.Wrapf(err, "error mounting container to preserve volume %q", path)
+	}
+	if info, err := os.Stat(filepath.Join(mountpoint, path)); err == nil {
+		s.volumeCacheInfo[path] = info
+	}
+	s.volumeCache[path] = path
+	return nil
+}
+
+// EnsureContainerPath implements imagebuilder.Executor, creating path inside
+// the build container if it doesn't already exist.
+func (s *StageExecutor) EnsureContainerPath(path string) error {
+	return s.EnsureContainerPathAs(path, "", nil)
+}
+
+// EnsureContainerPathAs implements imagebuilder.Executor, creating path
+// inside the build container, owned by user (if given) and with the given
+// mode (if set).
+func (s *StageExecutor) EnsureContainerPathAs(path, user string, mode *os.FileMode) error {
+	mountpoint, err := s.builder.Mount("")
+	if err != nil {
+		return errors.Wrapf(err, "error mounting container to create %q", path)
+	}
+	perm := os.FileMode(0755)
+	if mode != nil {
+		perm = *mode
+	}
+	if err := os.MkdirAll(filepath.Join(mountpoint, path), perm); err != nil {
+		return errors.Wrapf(err, "error creating %q in container", path)
+	}
+	return nil
+}
+
+// layerInfo looks up the uncompressed diff ID and size of the layer that
+// imageID's commit added, for StepCommitted.  It returns zero values rather
+// than an error, since losing this detail from an event isn't worth failing
+// the build over.
+func (s *StageExecutor) layerInfo(imageID string) (string, int64) {
+	img, err := s.executor.store.Image(imageID)
+	if err != nil {
+		logrus.Debugf("event: couldn't look up image %q to report layer info: %v", imageID, err)
+		return "", 0
+	}
+	layer, err := s.executor.store.Layer(img.TopLayer)
+	if err != nil {
+		logrus.Debugf("event: couldn't look up layer %q to report layer info: %v", img.TopLayer, err)
+		return "", 0
+	}
+	return layer.UncompressedDigest.String(), layer.UncompressedSize
+}
+
+// commitFinal commits the stage's build container under the requested
+// output name, producing the stage's final image, and returns that image's
+// ID and canonical reference.
+func (s *StageExecutor) commitFinal(ctx context.Context, builder *buildah.Builder, output string) (string, reference.Canonical, error) {
+	imageRef, err := s.executor.resolveNameToImageRef(output)
+	if err != nil {
+		return "", nil, err
+	}
+	if id, ref, _, err := builder.Commit(ctx, imageRef, buildah.CommitOptions{
+		SystemContext: s.executor.systemContext,
+	}); err != nil {
+		return "", nil, errors.Wrapf(err, "error committing image %q for stage %q", output, s.name)
+	} else {
+		logrus.Debugf("committed %q as final image for stage %q", output, s.name)
+		return id, ref, nil
+	}
+}
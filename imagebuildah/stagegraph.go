@@ -0,0 +1,154 @@
+package imagebuildah
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/openshift/imagebuilder"
+	"github.com/pkg/errors"
+)
+
+// stageNode is one vertex in a stage dependency graph: the names of the
+// stages that must finish before this one can start, and a channel that's
+// closed once this stage itself has finished (successfully or not).
+type stageNode struct {
+	name    string
+	parents []string
+	done    chan struct{}
+	// err is set, if non-nil, before done is closed, so that anything
+	// waiting on done can learn the stage failed without racing the
+	// scheduler's own bookkeeping.
+	err error
+}
+
+// stageGraph tracks the dependencies between stages of a multi-stage build,
+// derived from FROM <stage> and COPY/ADD --from=<stage> references, so that
+// stages which don't depend on each other can be scheduled concurrently
+// instead of strictly in Dockerfile order.
+type stageGraph struct {
+	nodes map[string]*stageNode
+}
+
+// argRef matches a $VAR or ${VAR} reference in an instruction's raw text, for
+// the limited variable expansion buildStageGraph needs to do on --from=
+// values; it doesn't need to handle the full Dockerfile word-expansion
+// syntax (escaping, ${VAR:-default}, etc.), since anything it gets wrong
+// just means a dependency edge is missed or kept, not a build miscompile.
+var argRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+
+// expandArgs replaces $VAR/${VAR} references in value with their value in
+// scope, leaving references to names that aren't in scope untouched.
+func expandArgs(value string, scope map[string]string) string {
+	return argRef.ReplaceAllStringFunc(value, func(match string) string {
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(match, "${"), "$"), "}")
+		if v, ok := scope[name]; ok {
+			return v
+		}
+		return match
+	})
+}
+
+// buildStageGraph derives a stageGraph from the parsed stages, recording,
+// for each stage, every other stage that it names as a parent via its FROM
+// instruction or a --from= flag on a COPY/ADD instruction.  Each stage is
+// reachable from the graph by either its name or its positional index, the
+// same way Executor.stages is indexed.
+//
+// --from= values (and FROM's own image/stage name) go through variable
+// expansion first, using b.args plus whatever ARG defaults were declared
+// earlier in the same stage, so that a reference like "--from=${BUILDER}"
+// still resolves to the right parent stage.
+func (b *Executor) buildStageGraph(stages imagebuilder.Stages) (*stageGraph, error) {
+	names := make(map[string]bool)
+	for _, stage := range stages {
+		names[stage.Name] = true
+		names[fmt.Sprintf("%d", stage.Position)] = true
+	}
+
+	g := &stageGraph{nodes: make(map[string]*stageNode)}
+	for _, stage := range stages {
+		node := &stageNode{name: stage.Name, done: make(chan struct{})}
+		scope := make(map[string]string)
+		for k, v := range b.args {
+			scope[k] = v
+		}
+		for line := stage.Node; line != nil; line = line.Next {
+			for _, child := range line.Children {
+				switch strings.ToUpper(child.Value) {
+				case "ARG":
+					if child.Next == nil {
+						continue
+					}
+					list := strings.SplitN(child.Next.Value, "=", 2)
+					if len(list) == 2 {
+						if _, overridden := b.args[list[0]]; !overridden {
+							scope[list[0]] = list[1]
+						}
+					}
+				case "FROM":
+					if child.Next != nil {
+						from := expandArgs(child.Next.Value, scope)
+						if names[from] {
+							node.parents = append(node.parents, from)
+						}
+					}
+				case "ADD", "COPY":
+					for _, flag := range child.Flags {
+						if strings.HasPrefix(flag, "--from=") {
+							from := expandArgs(strings.TrimPrefix(flag, "--from="), scope)
+							if names[from] {
+								node.parents = append(node.parents, from)
+							}
+						}
+					}
+				}
+			}
+		}
+		g.nodes[stage.Name] = node
+		g.nodes[fmt.Sprintf("%d", stage.Position)] = node
+	}
+
+	if err := g.checkCycles(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// checkCycles fails with a clear error if the graph contains a dependency
+// cycle, which would otherwise deadlock the scheduler in Executor.Build.
+func (g *stageGraph) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		node, ok := g.nodes[name]
+		if !ok {
+			return nil
+		}
+		switch state[node.name] {
+		case visiting:
+			return errors.Errorf("error building: dependency cycle detected among stages: %s -> %s", strings.Join(path, " -> "), node.name)
+		case visited:
+			return nil
+		}
+		state[node.name] = visiting
+		for _, parent := range node.parents {
+			if err := visit(parent, append(path, node.name)); err != nil {
+				return err
+			}
+		}
+		state[node.name] = visited
+		return nil
+	}
+	for _, stage := range g.nodes {
+		if err := visit(stage.name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
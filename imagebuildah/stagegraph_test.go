@@ -0,0 +1,101 @@
+package imagebuildah
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// parseStagesForTest parses a Dockerfile body into stages the way NewExecutor
+// and Build do, without needing a store or any of the rest of Executor.
+func parseStagesForTest(t *testing.T, dockerfile string) imagebuilder.Stages {
+	t.Helper()
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("parsing test Dockerfile: %v", err)
+	}
+	stages, err := imagebuilder.NewStages(node, imagebuilder.NewBuilder(nil))
+	if err != nil {
+		t.Fatalf("building test stages: %v", err)
+	}
+	return stages
+}
+
+func TestExpandArgsSubstitutesKnownVars(t *testing.T) {
+	scope := map[string]string{"BUILDER": "build", "TAG": "v1"}
+	cases := map[string]string{
+		"$BUILDER":       "build",
+		"${BUILDER}":     "build",
+		"${BUILDER}:tag": "build:tag",
+		"$TAG":           "v1",
+		"$UNKNOWN":       "$UNKNOWN",
+		"plain":          "plain",
+	}
+	for in, want := range cases {
+		if got := expandArgs(in, scope); got != want {
+			t.Errorf("expandArgs(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBuildStageGraphResolvesFromAndCopyFromParents(t *testing.T) {
+	stages := parseStagesForTest(t, `
+FROM alpine AS builder
+RUN make
+
+FROM builder AS staged
+COPY --from=builder /out /out
+
+FROM staged
+COPY --from=staged /out /final
+`)
+
+	b := &Executor{}
+	g, err := b.buildStageGraph(stages)
+	if err != nil {
+		t.Fatalf("buildStageGraph: %v", err)
+	}
+
+	if parents := g.nodes["staged"].parents; len(parents) != 2 || parents[0] != "builder" || parents[1] != "builder" {
+		t.Fatalf("staged parents = %v, want [builder builder]", parents)
+	}
+	if parents := g.nodes["2"].parents; len(parents) != 2 || parents[0] != "staged" || parents[1] != "staged" {
+		t.Fatalf("final stage parents = %v, want [staged staged]", parents)
+	}
+}
+
+func TestBuildStageGraphExpandsArgInFrom(t *testing.T) {
+	stages := parseStagesForTest(t, `
+FROM alpine AS builder
+RUN make
+
+ARG BASE=builder
+FROM ${BASE}
+COPY --from=builder /out /out
+`)
+
+	b := &Executor{args: map[string]string{"BASE": "builder"}}
+	g, err := b.buildStageGraph(stages)
+	if err != nil {
+		t.Fatalf("buildStageGraph: %v", err)
+	}
+	if parents := g.nodes["1"].parents; len(parents) != 2 || parents[0] != "builder" || parents[1] != "builder" {
+		t.Fatalf("stage 1 parents = %v, want [builder builder]", parents)
+	}
+}
+
+func TestBuildStageGraphDetectsCycles(t *testing.T) {
+	stages := parseStagesForTest(t, `
+FROM scratch AS a
+COPY --from=b /x /x
+
+FROM scratch AS b
+COPY --from=a /x /x
+`)
+
+	b := &Executor{}
+	if _, err := b.buildStageGraph(stages); err == nil {
+		t.Fatalf("expected a dependency cycle error, got nil")
+	}
+}